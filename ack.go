@@ -0,0 +1,242 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultVisibility - время, в течение которого выданное потребителю
+// сообщение считается недоступным для повторной выдачи, если не задано
+// явно параметром запроса ?visibility=N.
+const defaultVisibility = 30 * time.Second
+
+// idGenerator выдаёт уникальные монотонно растущие ID сообщений, общие для
+// прямой раздачи через channelPool и для Store. Единое пространство ID
+// нужно, чтобы DELETE /{queue}/{id} и POST /{queue}/{id}/nack однозначно
+// ссылались на сообщение независимо от того, как оно было доставлено.
+type idGenerator struct {
+	next atomic.Uint64
+}
+
+// Seed поднимает счётчик выше уже известного максимума - вызывается один
+// раз при старте с ID, восстановленными из журнала, чтобы не выдать после
+// перезапуска идентификатор, который уже занят.
+func (g *idGenerator) Seed(maxSeen uint64) {
+	g.next.Store(maxSeen)
+}
+
+// NextID возвращает следующий свободный ID.
+func (g *idGenerator) NextID() uint64 {
+	return g.next.Add(1)
+}
+
+// deliveryResponse - тело ответа GET /{queue} в режиме подтверждений.
+type deliveryResponse struct {
+	ID      uint64 `json:"id"`
+	Payload string `json:"payload"`
+}
+
+// inFlightMessage - сообщение, выданное потребителю и ожидающее ack/nack.
+type inFlightMessage struct {
+	queue      string
+	id         uint64
+	payload    string
+	deadline   time.Time
+	deliveries int
+
+	// pendingDLQ отмечает сообщение, исчерпавшее maxDeliveries и ожидающее
+	// повторной попытки push в dead-letter очередь. Пока флаг установлен,
+	// Ack/Nack от исходного потребителя не должны подтверждать сообщение
+	// напрямую - иначе опоздавший ack потеряет сообщение, так и не попавшее
+	// в DLQ.
+	pendingDLQ bool
+}
+
+// AckTracker реализует SQS-подобную семантику поверх Store: каждое
+// выданное потребителю сообщение получает visibility timeout и
+// автоматически возвращается в начало очереди, если не подтверждено (ack)
+// до дедлайна. Сообщения, превысившие maxDeliveries попыток, уходят в
+// dead-letter очередь "{queue}.dlq" вместо повторной выдачи.
+type AckTracker struct {
+	store *boundedStore
+	// pool используется только для попытки немедленной прямой выдачи
+	// dead-letter сообщения уже ожидающему long-poll потребителю
+	// "{queue}.dlq", аналогично putQueueHandler - чтобы не ждать его
+	// собственного таймера, если консьюмер уже подписан.
+	pool          *channelPool
+	ids           *idGenerator
+	maxDeliveries int
+
+	mx             sync.Mutex
+	inFlight       map[uint64]*inFlightMessage
+	deliveryCounts map[uint64]int
+	lastDLQWarn    map[string]time.Time
+}
+
+// NewAckTracker создаёт трекер подтверждений и запускает фоновый sweeper,
+// возвращающий в очередь сообщения с истёкшим visibility timeout.
+func NewAckTracker(store *boundedStore, pool *channelPool, ids *idGenerator, maxDeliveries int) *AckTracker {
+	t := &AckTracker{
+		store:          store,
+		pool:           pool,
+		ids:            ids,
+		maxDeliveries:  maxDeliveries,
+		inFlight:       make(map[uint64]*inFlightMessage),
+		deliveryCounts: make(map[uint64]int),
+		lastDLQWarn:    make(map[string]time.Time),
+	}
+	go t.sweepLoop()
+	return t
+}
+
+// Deliver регистрирует выдачу сообщения потребителю с заданным visibility
+// timeout, увеличивая счётчик попыток доставки.
+func (t *AckTracker) Deliver(queue string, id uint64, payload string, visibility time.Duration) int {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	t.deliveryCounts[id]++
+	deliveries := t.deliveryCounts[id]
+
+	t.inFlight[id] = &inFlightMessage{
+		queue:      queue,
+		id:         id,
+		payload:    payload,
+		deadline:   time.Now().Add(visibility),
+		deliveries: deliveries,
+	}
+
+	return deliveries
+}
+
+// Ack подтверждает обработку сообщения и удаляет его из очереди навсегда.
+// Возвращает false, если сообщение не найдено в списке выданных (уже
+// подтверждено, опоздало и ожидает push в DLQ, или ID неверный).
+func (t *AckTracker) Ack(queue string, id uint64) bool {
+	t.mx.Lock()
+	m, ok := t.inFlight[id]
+	if !ok || m.queue != queue || m.pendingDLQ {
+		t.mx.Unlock()
+		return false
+	}
+	delete(t.inFlight, id)
+	delete(t.deliveryCounts, id)
+	t.mx.Unlock()
+
+	t.store.ack(queue, id)
+	return true
+}
+
+// Nack явно возвращает сообщение в очередь до истечения visibility
+// timeout, не дожидаясь sweeper'а.
+func (t *AckTracker) Nack(queue string, id uint64) bool {
+	t.mx.Lock()
+	m, ok := t.inFlight[id]
+	if !ok || m.queue != queue || m.pendingDLQ {
+		t.mx.Unlock()
+		return false
+	}
+	delete(t.inFlight, id)
+	t.mx.Unlock()
+
+	t.redeliverOrDeadLetter(m)
+	return true
+}
+
+// sweepLoop периодически возвращает в очередь сообщения, чей visibility
+// timeout истёк без подтверждения.
+func (t *AckTracker) sweepLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var expired []*inFlightMessage
+
+		t.mx.Lock()
+		for id, m := range t.inFlight {
+			if now.After(m.deadline) {
+				expired = append(expired, m)
+				delete(t.inFlight, id)
+			}
+		}
+		t.mx.Unlock()
+
+		for _, m := range expired {
+			t.redeliverOrDeadLetter(m)
+		}
+	}
+}
+
+// dlqRetryInterval - пауза перед повторной попыткой push в dead-letter
+// очередь, если предыдущая попытка не удалась (например, "{queue}.dlq" сама
+// упёрлась в -cap).
+const dlqRetryInterval = time.Second
+
+// redeliverOrDeadLetter возвращает сообщение в начало очереди для
+// повторной доставки под тем же ID, либо, если превышен maxDeliveries,
+// публикует его копию в dead-letter очередь "{queue}.dlq" под новым ID и
+// только после этого подтверждает исходное сообщение. Если push в DLQ не
+// удался, исходное сообщение не ack'ается: оно возвращается в inFlight с
+// dlqRetryInterval, чтобы sweeper повторил попытку вместо того, чтобы
+// молча потерять сообщение.
+func (t *AckTracker) redeliverOrDeadLetter(m *inFlightMessage) {
+	if m.deliveries >= t.maxDeliveries {
+		dlqID := t.ids.NextID()
+
+		// Пробуем отдать сообщение напрямую уже ожидающему long-poll
+		// потребителю "{queue}.dlq", как и putQueueHandler - иначе оно
+		// пролежит в хранилище до истечения таймаута этого потребителя.
+		if t.pool.sendMessage(m.queue+".dlq", queueMessage{id: dlqID, msg: m.payload}) {
+			t.mx.Lock()
+			delete(t.deliveryCounts, m.id)
+			t.mx.Unlock()
+
+			t.store.ack(m.queue, m.id)
+			return
+		}
+
+		if err := t.store.push(m.queue+".dlq", dlqID, m.payload); err != nil {
+			t.warnDLQFull(m.queue, err)
+
+			m.pendingDLQ = true
+			m.deadline = time.Now().Add(dlqRetryInterval)
+			t.mx.Lock()
+			t.inFlight[m.id] = m
+			t.mx.Unlock()
+			return
+		}
+
+		t.mx.Lock()
+		delete(t.deliveryCounts, m.id)
+		t.mx.Unlock()
+
+		t.store.ack(m.queue, m.id)
+		return
+	}
+
+	// Пробуем отдать сообщение напрямую уже ожидающему long-poll
+	// потребителю той же очереди, как и putQueueHandler и DLQ-путь выше -
+	// иначе оно пролежит в хранилище до истечения таймаута long-poll'а
+	// потребителя, который только начнёт ждать после этого nack/timeout.
+	if t.pool.sendMessage(m.queue, queueMessage{id: m.id, msg: m.payload}) {
+		return
+	}
+
+	t.store.requeueFront(m.queue, m.id, m.payload)
+}
+
+// warnDLQFull логирует неудачный push в dead-letter очередь, не чаще раза в
+// capLogInterval на очередь, аналогично boundedStore.warnFull.
+func (t *AckTracker) warnDLQFull(queue string, err error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if last, ok := t.lastDLQWarn[queue]; ok && time.Since(last) < capLogInterval {
+		return
+	}
+	t.lastDLQWarn[queue] = time.Now()
+
+	log.Printf("warn: не удалось отправить сообщение очереди %q в dead-letter очередь %q: %v", queue, queue+".dlq", err)
+}
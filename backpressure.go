@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// capLogInterval - минимальный интервал между повторными warn-логами о
+// переполнении одной и той же очереди, чтобы не заспамить лог при
+// продолжающейся нагрузке, как это делают пулы воркеров при насыщении.
+const capLogInterval = time.Minute
+
+// ErrQueueFull возвращается push, когда глубина очереди достигла cap.
+// RetryAfter - рекомендованная пауза перед повторной попыткой.
+type ErrQueueFull struct {
+	Queue      string
+	RetryAfter time.Duration
+}
+
+func (e *ErrQueueFull) Error() string {
+	return fmt.Sprintf("очередь %q заполнена", e.Queue)
+}
+
+// boundedStore оборачивает Store и отклоняет push, когда глубина очереди
+// достигает cap - глобального по умолчанию либо per-queue override,
+// заданного через PUT ?cap=N.
+type boundedStore struct {
+	Store
+
+	mx         sync.Mutex
+	defaultCap int
+	caps       map[string]int
+	lastWarn   map[string]time.Time
+}
+
+// newBoundedStore оборачивает backend лимитом глубины очереди по умолчанию.
+// defaultCap == 0 означает отсутствие лимита, пока не задан per-queue override.
+func newBoundedStore(backend Store, defaultCap int) *boundedStore {
+	return &boundedStore{
+		Store:      backend,
+		defaultCap: defaultCap,
+		caps:       make(map[string]int),
+		lastWarn:   make(map[string]time.Time),
+	}
+}
+
+// setCap задаёт per-queue override глубины очереди. n <= 0 снимает override
+// и возвращает очередь к defaultCap.
+func (s *boundedStore) setCap(queue string, n int) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if n <= 0 {
+		delete(s.caps, queue)
+		return
+	}
+	s.caps[queue] = n
+}
+
+// capForLocked возвращает действующий cap очереди: override, если задан,
+// иначе значение по умолчанию. Вызывается под s.mx.
+func (s *boundedStore) capForLocked(queue string) int {
+	if c, ok := s.caps[queue]; ok {
+		return c
+	}
+	return s.defaultCap
+}
+
+// push кладёт сообщение в очередь через обёрнутый Store, либо возвращает
+// *ErrQueueFull, если это превысит действующий cap. Проверка глубины и сам
+// push держат s.mx на всё время вызова, иначе два конкурентных push на один
+// и тот же key могли бы оба пройти проверку раньше, чем кто-то из них
+// запишется, и провести очередь сквозь cap.
+func (s *boundedStore) push(key string, id uint64, msg string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	cap := s.capForLocked(key)
+	if cap > 0 {
+		if depth := s.Store.depth(key); depth >= cap {
+			s.warnFullLocked(key)
+			return &ErrQueueFull{Queue: key, RetryAfter: backoffFor(depth, cap)}
+		}
+	}
+
+	s.Store.push(key, id, msg)
+	return nil
+}
+
+// warnFullLocked логирует достижение очередью cap, не чаще раза в
+// capLogInterval на очередь. Вызывается под s.mx.
+func (s *boundedStore) warnFullLocked(queue string) {
+	if last, ok := s.lastWarn[queue]; ok && time.Since(last) < capLogInterval {
+		return
+	}
+	s.lastWarn[queue] = time.Now()
+
+	log.Printf("warn: очередь %q достигла предела глубины", queue)
+}
+
+// backoffFor вычисляет паузу перед повторной попыткой по экспоненциальной
+// схеме (база 1с, множитель 1.6, джиттер 20%), растущей вместе с
+// превышением глубины над cap и ограниченной 30с.
+func backoffFor(depth, cap int) time.Duration {
+	const (
+		base    = time.Second
+		factor  = 1.6
+		jitter  = 0.2
+		maxWait = 30 * time.Second
+	)
+
+	over := depth - cap + 1
+	if over < 1 {
+		over = 1
+	}
+
+	wait := float64(base) * math.Pow(factor, float64(over-1))
+	wait += wait * jitter * (rand.Float64()*2 - 1)
+
+	if wait > float64(maxWait) {
+		wait = float64(maxWait)
+	}
+	if wait < float64(base) {
+		wait = float64(base)
+	}
+
+	return time.Duration(wait)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Message - это единица данных, публикуемая в топик.
+type Message struct {
+	ID      uint64    `json:"id"`
+	Topic   string    `json:"topic"`
+	Payload string    `json:"payload"`
+	Created time.Time `json:"created"`
+}
+
+// Topic хранит историю публикаций и подписчиков одного топика широковещательной
+// (fan-out) доставки, в отличие от channelPool, который отдаёт сообщение
+// только одному потребителю.
+type Topic struct {
+	mx sync.Mutex
+
+	Name     string
+	Sequence uint64
+	Created  time.Time
+	TTL      time.Duration
+
+	lastActivity time.Time
+	messages     []Message
+	Listeners    map[string]chan Message
+}
+
+func newTopic(name string, ttl time.Duration) *Topic {
+	now := time.Now()
+	return &Topic{
+		Name:         name,
+		Created:      now,
+		TTL:          ttl,
+		lastActivity: now,
+		Listeners:    make(map[string]chan Message),
+	}
+}
+
+// publish добавляет сообщение в историю топика и рассылает его подписчикам.
+func (t *Topic) publish(payload string) Message {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	t.Sequence++
+	t.lastActivity = time.Now()
+
+	msg := Message{
+		ID:      t.Sequence,
+		Topic:   t.Name,
+		Payload: payload,
+		Created: t.lastActivity,
+	}
+	t.messages = append(t.messages, msg)
+
+	t.notifyAll(msg)
+
+	return msg
+}
+
+// notifyAll рассылает сообщение всем зарегистрированным подписчикам.
+// Вызывается под t.mx. Отправка неблокирующая по тем же причинам, что и в
+// channelPool.sendMessage: медленный подписчик не должен вешать паблишеров.
+func (t *Topic) notifyAll(msg Message) {
+	for id, ch := range t.Listeners {
+		select {
+		case ch <- msg:
+		default:
+			// Подписчик не успевает вычитывать - отключаем его, чтобы не
+			// накапливать пропуски молча.
+			close(ch)
+			delete(t.Listeners, id)
+		}
+	}
+}
+
+// subscribe регистрирует нового подписчика и возвращает канал сообщений и
+// функцию отписки.
+func (t *Topic) subscribe(id string) (chan Message, func()) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	ch := make(chan Message, 16)
+	t.Listeners[id] = ch
+	t.lastActivity = time.Now()
+
+	return ch, func() {
+		t.mx.Lock()
+		defer t.mx.Unlock()
+
+		if existing, ok := t.Listeners[id]; ok && existing == ch {
+			delete(t.Listeners, id)
+			close(ch)
+		}
+	}
+}
+
+// since возвращает сообщения с sequence строго больше seq, для long-poll
+// клиентов без WebSocket.
+func (t *Topic) since(seq uint64) []Message {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	var out []Message
+	for _, m := range t.messages {
+		if m.ID > seq {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// setTTL переопределяет TTL простоя топика, например по запросу клиента
+// через POST /topic/{name}?ttl=N.
+func (t *Topic) setTTL(ttl time.Duration) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	t.TTL = ttl
+}
+
+// idle сообщает, не истёк ли TTL топика при отсутствии подписчиков.
+func (t *Topic) idle(now time.Time) bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	return len(t.Listeners) == 0 && t.TTL > 0 && now.Sub(t.lastActivity) > t.TTL
+}
+
+// Broker управляет топиками pub/sub-доставки, живущими рядом с
+// channelPool/store, обслуживающими очереди с семантикой "одному из
+// потребителей".
+type Broker struct {
+	mx         sync.Mutex
+	topics     map[string]*Topic
+	defaultTTL time.Duration
+}
+
+// NewBroker создаёт брокер топиков с TTL простоя по умолчанию для GC.
+func NewBroker(defaultTTL time.Duration) *Broker {
+	b := &Broker{
+		topics:     make(map[string]*Topic),
+		defaultTTL: defaultTTL,
+	}
+	go b.gcLoop()
+	return b
+}
+
+// topic возвращает топик по имени, создавая его при первом обращении.
+func (b *Broker) topic(name string) *Topic {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	t, ok := b.topics[name]
+	if !ok {
+		t = newTopic(name, b.defaultTTL)
+		b.topics[name] = t
+	}
+	return t
+}
+
+// gcLoop периодически удаляет из брокера топики, простаивающие без
+// подписчиков дольше своего TTL.
+func (b *Broker) gcLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		b.mx.Lock()
+		for name, t := range b.topics {
+			if t.idle(now) {
+				delete(b.topics, name)
+			}
+		}
+		b.mx.Unlock()
+	}
+}
+
+// getTopicName разбирает путь вида /topic/{name} или /topic/{name}/ws и
+// возвращает имя топика, признак запроса на WebSocket и успех разбора.
+func getTopicName(path string) (name string, isWS bool, ok bool) {
+	rest := strings.TrimPrefix(path, "/topic/")
+	if rest == path || rest == "" {
+		return "", false, false
+	}
+
+	rest, isWS = strings.CutSuffix(rest, "/ws")
+	if rest == "" {
+		return "", false, false
+	}
+
+	return rest, isWS, true
+}
+
+// topicHandler обеспечивает разделение обработки запросов режима pub/sub по
+// методам и хвосту пути, аналогично queueHandler. shutdown отменяется при
+// остановке сервера и пробуждает ожидающие pollTopicHandler и topicWSHandler
+// запросы.
+func topicHandler(broker *Broker, shutdown context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, isWS, ok := getTopicName(r.URL.Path)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case isWS && r.Method == http.MethodGet:
+			websocket.Handler(topicWSHandler(broker, name, shutdown)).ServeHTTP(w, r)
+		case r.Method == http.MethodPost:
+			publishTopicHandler(broker, name, w, r)
+		case r.Method == http.MethodGet:
+			pollTopicHandler(broker, name, shutdown, w, r)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+}
+
+// publishTopicHandler обработчик POST-запроса, публикующего сообщение в
+// топик и рассылающего его всем текущим подписчикам. ?ttl=N (в секундах)
+// переопределяет TTL простоя конкретного топика, заданный по умолчанию
+// флагом -topic-ttl.
+func publishTopicHandler(broker *Broker, name string, w http.ResponseWriter, r *http.Request) {
+	msg, ok := getQueueMessage(r.URL)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	t := broker.topic(name)
+
+	if ttlValue := r.URL.Query().Get("ttl"); ttlValue != "" {
+		if seconds, err := strconv.ParseInt(ttlValue, 10, 64); err == nil && seconds >= 0 {
+			t.setTTL(time.Duration(seconds) * time.Second)
+		}
+	}
+
+	t.publish(msg)
+}
+
+// pollTopicHandler обработчик GET-запроса для HTTP-клиентов без WebSocket:
+// отдаёт накопленные с sequence=seq сообщения, либо ждёт их появления по
+// таймеру, аналогично getQueueHandler. shutdown отменяется при остановке
+// сервера, чтобы не держать соединение до истечения long-poll таймера.
+func pollTopicHandler(broker *Broker, name string, shutdown context.Context, w http.ResponseWriter, r *http.Request) {
+	seq, _ := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+
+	t := broker.topic(name)
+
+	if msgs := t.since(seq); len(msgs) > 0 {
+		writeJSON(w, msgs)
+		return
+	}
+
+	timeout, hasTimeout := getRequestTimeout(r.URL, *maxLongPollTimeout)
+	if !hasTimeout {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	subID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	ch, unsubscribe := t.subscribe(subID)
+	defer unsubscribe()
+
+	timeoutTimer := time.NewTimer(timeout)
+	defer timeoutTimer.Stop()
+
+	select {
+	case <-shutdown.Done():
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case <-r.Context().Done():
+		// Клиент отключился, не дождавшись ответа - отвечаем тем же кодом,
+		// что и getQueueHandler, хоть клиент его уже и не увидит.
+		if r.Context().Err() == context.Canceled {
+			w.WriteHeader(499) // Client Closed Request (де-факто стандарт nginx).
+		} else {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+	case <-timeoutTimer.C:
+		w.WriteHeader(http.StatusNotFound)
+	case msg, ok := <-ch:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, []Message{msg})
+	}
+}
+
+// topicWSHandler возвращает обработчик WebSocket-подписки: каждое новое
+// сообщение топика немедленно уходит подписчику в формате JSON. shutdown
+// отменяется при остановке сервера, чтобы закрыть соединение и не держать
+// эту горутину навсегда, дожидаясь httpServer.Shutdown().
+func topicWSHandler(broker *Broker, name string, shutdown context.Context) func(*websocket.Conn) {
+	return func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		t := broker.topic(name)
+		subID := strconv.FormatInt(time.Now().UnixNano(), 36)
+		ch, unsubscribe := t.subscribe(subID)
+		defer unsubscribe()
+
+		for {
+			select {
+			case <-shutdown.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err := websocket.JSON.Send(ws, msg); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeJSON сериализует значение в тело ответа как JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
@@ -15,22 +17,79 @@ import (
 )
 
 var port = flag.String("p", "8080", "webserver port number")
+var storeFlag = flag.String("store", "memory", `хранилище очередей: "memory" или "wal:/path/to/dir"`)
+var fsyncFlag = flag.String("fsync", "always", `политика fsync для wal-хранилища: "always", "never" или "interval=Ns"`)
+var queueCap = flag.Int("cap", 0, "предел глубины очереди по умолчанию (0 - без ограничения)")
+var maxDeliveries = flag.Int("max-deliveries", 5, "число попыток доставки сообщения, после которого оно уходит в dead-letter очередь")
+var topicTTL = flag.Duration("topic-ttl", 10*time.Minute, "TTL простоя топика по умолчанию, после которого он удаляется брокером при отсутствии подписчиков (0 - не удалять); переопределяется для конкретного топика через POST /topic/{name}?ttl=N (в секундах)")
+
+var readHeaderTimeout = flag.Duration("read-header-timeout", 5*time.Second, "http.Server.ReadHeaderTimeout")
+var readTimeout = flag.Duration("read-timeout", 30*time.Second, "http.Server.ReadTimeout")
+var writeTimeout = flag.Duration("write-timeout", 65*time.Second, "http.Server.WriteTimeout; должен превышать -max-timeout")
+var idleTimeout = flag.Duration("idle-timeout", 120*time.Second, "http.Server.IdleTimeout")
+var handlerTimeout = flag.Duration("handler-timeout", 60*time.Second, "верхняя граница удержания соединения обработчиком (http.TimeoutHandler)")
+var maxLongPollTimeout = flag.Duration("max-timeout", 55*time.Second, "максимальное значение ?timeout=, принимаемое long-poll запросами")
+
+// timeoutResponseBody - тело ответа, которое http.TimeoutHandler отдаёт
+// клиенту, если обработчик не уложился в handlerTimeout.
+const timeoutResponseBody = `{"error":{"code":503,"message":"Request timeout"}}`
 
 func main() {
 	flag.Parse()
 
-	store := newStore()
+	if *writeTimeout <= *maxLongPollTimeout {
+		log.Fatalf("write-timeout (%s) должен превышать max-timeout (%s), иначе long-poll ответы будут обрываться сервером раньше собственного таймаута", *writeTimeout, *maxLongPollTimeout)
+	}
+	if *handlerTimeout <= *maxLongPollTimeout {
+		log.Fatalf("handler-timeout (%s) должен превышать max-timeout (%s), иначе http.TimeoutHandler оборвёт long-poll раньше собственного таймаута обработчика", *handlerTimeout, *maxLongPollTimeout)
+	}
+
+	fsync, err := parseFsyncPolicy(*fsyncFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	backend, err := newStoreFromFlag(*storeFlag, fsync)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store := newBoundedStore(backend, *queueCap)
+
+	ids := &idGenerator{}
+	// wal-хранилище переживает перезапуск - сеем генератор выше уже
+	// занятых ID, чтобы не выдать дубликат после восстановления.
+	if seeder, ok := backend.(interface{ MaxID() uint64 }); ok {
+		ids.Seed(seeder.MaxID())
+	}
+
 	pool := NewHandlerPool()
+	broker := NewBroker(*topicTTL)
+	ack := NewAckTracker(store, pool, ids, *maxDeliveries)
+
+	// shutdownCtx отменяется при получении SIGINT, чтобы разбудить
+	// long-poll обработчики (getQueueHandler, pollTopicHandler) сразу, не
+	// дожидаясь истечения их собственных таймеров.
+	shutdownCtx, cancelShutdown := context.WithCancel(context.Background())
 
 	cfg := &queueHandlerConfig{
-		store: store,
-		pool:  pool,
+		store:    store,
+		pool:     pool,
+		ack:      ack,
+		ids:      ids,
+		shutdown: shutdownCtx,
 	}
 
-	http.HandleFunc("/", queueHandler(cfg))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", queueHandler(cfg))
+	mux.HandleFunc("/topic/", topicHandler(broker, shutdownCtx))
 
 	httpServer := http.Server{
-		Addr: ":" + *port,
+		Addr:              ":" + *port,
+		Handler:           withHandlerTimeout(mux, *handlerTimeout),
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
 	}
 
 	// Канал для ожидания закрытия соединений.
@@ -41,6 +100,9 @@ func main() {
 		sigint := make(chan os.Signal, 1)
 		signal.Notify(sigint, os.Interrupt)
 		<-sigint
+		// Будим все ожидающие long-poll запросы, чтобы они не держали
+		// Shutdown до истечения собственных таймеров.
+		cancelShutdown()
 		// Ожидаем, когда все запросы завершатся.
 		if err := httpServer.Shutdown(context.Background()); err != nil {
 			log.Fatal(err)
@@ -56,10 +118,44 @@ func main() {
 	<-idleConnectionsClosed
 }
 
+// withHandlerTimeout оборачивает next в http.TimeoutHandler, пропуская
+// WebSocket upgrade-запросы напрямую. websocket.Handler делает
+// w.(http.Hijacker).Hijack(), а ResponseWriter, которым http.TimeoutHandler
+// подменяет исходный, Hijacker не реализует - обернуть topicWSHandler так же,
+// как остальные обработчики, означало бы, что любое подключение к
+// /topic/{name}/ws падает с паникой. Сам апгрейд короткий, поэтому долгого
+// удержания соединения, от которого защищает handlerTimeout, здесь не
+// возникает.
+func withHandlerTimeout(next http.Handler, handlerTimeout time.Duration) http.Handler {
+	timeoutNext := http.TimeoutHandler(next, handlerTimeout, timeoutResponseBody)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		timeoutNext.ServeHTTP(w, r)
+	})
+}
+
+// isWebSocketUpgrade сообщает, является ли запрос запросом на апгрейд
+// соединения до WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Connection"), "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
 // queueHandlerConfig - это необходимая конфигурация для обработчиков запросов.
 type queueHandlerConfig struct {
-	store *store
+	store *boundedStore
 	pool  *channelPool
+	ack   *AckTracker
+	ids   *idGenerator
+	// shutdown отменяется при остановке сервера, чтобы прервать ожидающие
+	// long-poll запросы, не дожидаясь их собственных таймеров.
+	shutdown context.Context
 }
 
 // queueHandler обеспечивает разделение обработки по методам запроса.
@@ -70,6 +166,10 @@ func queueHandler(cfg *queueHandlerConfig) http.HandlerFunc {
 			cfg.putQueueHandler(w, r)
 		case http.MethodGet:
 			cfg.getQueueHandler(w, r)
+		case http.MethodDelete:
+			cfg.ackQueueHandler(w, r)
+		case http.MethodPost:
+			cfg.nackQueueHandler(w, r)
 		default:
 			w.WriteHeader(http.StatusBadRequest)
 		}
@@ -90,15 +190,33 @@ func (c *queueHandlerConfig) putQueueHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	if capValue := r.URL.Query().Get("cap"); capValue != "" {
+		if n, err := strconv.Atoi(capValue); err == nil {
+			c.store.setCap(name, n)
+		}
+	}
+
+	id := c.ids.NextID()
+
 	// Попытка отправить сообщение обработчикам.
-	isSended := c.pool.sendMessage(name, msg)
+	isSended := c.pool.sendMessage(name, queueMessage{id: id, msg: msg})
 	// Если нет обработчиков ожидающих сообщения, то кладём в хранилище.
 	if !isSended {
-		c.store.push(name, msg)
+		if err := c.store.push(name, id, msg); err != nil {
+			var full *ErrQueueFull
+			if errors.As(err, &full) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(full.RetryAfter.Seconds()))))
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+		}
 	}
 }
 
 // getQueueHandler обработчик GET запроса на получение данных из очереди.
+// Сообщение не удаляется окончательно: оно переходит в состояние in-flight
+// с visibility timeout и должно быть подтверждено через DELETE
+// /{queue}/{id}, иначе будет выдано повторно.
 func (c *queueHandlerConfig) getQueueHandler(w http.ResponseWriter, r *http.Request) {
 	name, ok := getQueueName(r.URL)
 	if !ok {
@@ -106,10 +224,11 @@ func (c *queueHandlerConfig) getQueueHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	timeout, hasTimeout := getRequestTimeout(r.URL)
+	visibility := getVisibility(r.URL)
+	timeout, hasTimeout := getRequestTimeout(r.URL, *maxLongPollTimeout)
 
 	// Пробуем получить сообщение из хранилища.
-	msg, ok := c.store.pop(name)
+	id, msg, ok := c.store.pop(name)
 	// Если нет сообщений и не нужно ждать сообщения, то выводим 404.
 	if !ok && !hasTimeout {
 		w.WriteHeader(http.StatusNotFound)
@@ -118,7 +237,7 @@ func (c *queueHandlerConfig) getQueueHandler(w http.ResponseWriter, r *http.Requ
 
 	// Вывод сообщения если оно есть.
 	if ok {
-		w.Write([]byte(msg))
+		c.deliver(w, name, id, msg, visibility)
 		return
 	}
 
@@ -126,92 +245,133 @@ func (c *queueHandlerConfig) getQueueHandler(w http.ResponseWriter, r *http.Requ
 	if hasTimeout {
 
 		// Инициализируем канал, по которому получем сообщение.
-		ch := make(chan string, 1)
+		ch := make(chan queueMessage, 1)
 		defer close(ch)
 
 		// Добавляем канал в очередь на получение сообщения.
 		c.pool.addToQueue(name, ch)
 
 		timeoutTimer := time.NewTimer(timeout)
+		defer timeoutTimer.Stop()
 
-		// В зависимости что придёт раньше (таймаут или сообщение), будет обработка.
+		// В зависимости что придёт раньше (таймаут, сообщение, отключение
+		// клиента или остановка сервера), будет обработка.
 		select {
+		case <-c.shutdown.Done():
+			// Сервер завершает работу - не держим соединение до истечения
+			// long-poll таймера, отдаём клиенту немедленно.
+			c.pool.removeFromQueue(name, ch)
+			c.drainRace(name, ch)
+
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+		case <-r.Context().Done():
+			// Клиент отключился, не дождавшись ответа. Убираем канал из пула,
+			// иначе он останется висеть и заблокирует sendMessage навсегда.
+			c.pool.removeFromQueue(name, ch)
+			c.drainRace(name, ch)
+
+			if r.Context().Err() == context.Canceled {
+				w.WriteHeader(499) // Client Closed Request (де-факто стандарт nginx).
+			} else {
+				w.WriteHeader(http.StatusGatewayTimeout)
+			}
+
 		case <-timeoutTimer.C:
 			// Так как время вышло, то удаляем канал с приёма сообщения.
 			c.pool.removeFromQueue(name, ch)
+			c.drainRace(name, ch)
 
 			w.WriteHeader(http.StatusNotFound)
 
-		case msg := <-ch:
+		case m := <-ch:
 			// Удаляемся из очереди, так как сообщение получено.
 			c.pool.removeFromQueue(name, ch)
 
-			w.Write([]byte(msg))
+			c.deliver(w, name, m.id, m.msg, visibility)
 		}
 	}
 }
 
-// Хранилище очереди сообщений по ключу
-type store struct {
-	mx   sync.Mutex
-	data map[string][]string
+// deliver регистрирует сообщение в трекере подтверждений с заданным
+// visibility timeout и отдаёт его клиенту как {id, payload}.
+func (c *queueHandlerConfig) deliver(w http.ResponseWriter, queue string, id uint64, msg string, visibility time.Duration) {
+	c.ack.Deliver(queue, id, msg, visibility)
+	writeJSON(w, deliveryResponse{ID: id, Payload: msg})
 }
 
-func newStore() *store {
-	return &store{
-		data: make(map[string][]string),
+// drainRace забирает сообщение из ch, если sendMessage успел доставить его
+// туда уже после removeFromQueue (гонка за pool.mx с завершившимся select:
+// таймер/отключение клиента/остановка сервера сработали раньше, чем
+// producer отправил сообщение в уже "снимаемый" канал). Без этого такое
+// сообщение было бы потеряно навсегда - оно не попало ни в хранилище, ни
+// клиенту. Найденное сообщение кладётся в store, как если бы получателей
+// вообще не было.
+func (c *queueHandlerConfig) drainRace(queue string, ch chan queueMessage) {
+	select {
+	case m := <-ch:
+		_ = c.store.push(queue, m.id, m.msg)
+	default:
 	}
 }
 
-// push позволяет положить ключ и сообщение в хранилище. Если сообщение уже есть,
-// то новое сообщение добавится в конец.
-func (s *store) push(key, msg string) {
-	s.mx.Lock()
-	defer s.mx.Unlock()
+// ackQueueHandler обработчик DELETE /{queue}/{id}, подтверждающий
+// обработку сообщения.
+func (c *queueHandlerConfig) ackQueueHandler(w http.ResponseWriter, r *http.Request) {
+	name, id, isNack, ok := getQueueMessageID(r.URL)
+	if !ok || isNack {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	s.data[key] = append(s.data[key], msg)
-}
+	if !c.ack.Ack(name, id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-// pop позволяет получить первый элемент ключа с удалением его из хранилища.
-func (s *store) pop(key string) (string, bool) {
-	s.mx.Lock()
-	defer s.mx.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	values, ok := s.data[key]
-	// Если нет сообщений по данному ключу.
-	if !ok || len(values) == 0 {
-		return "", false
+// nackQueueHandler обработчик POST /{queue}/{id}/nack, возвращающий
+// сообщение в очередь раньше истечения visibility timeout.
+func (c *queueHandlerConfig) nackQueueHandler(w http.ResponseWriter, r *http.Request) {
+	name, id, isNack, ok := getQueueMessageID(r.URL)
+	if !ok || !isNack {
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	// Получаем первое сообщение.
-	v, newValues := popSlice(values)
-
-	// Удаляем сообщение из хранилища.
-	if len(newValues) == 0 {
-		// Удаляем ключ, если больше нет элементов.
-		delete(s.data, key)
-	} else {
-		// Убираем первый элемент из слайса сообщений.
-		s.data[key] = newValues
+	if !c.ack.Nack(name, id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
 
-	return v, true
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queueMessage - сообщение, передаваемое напрямую ожидающему потребителю
+// через channelPool, минуя хранилище. Несёт ID, выданный тем же
+// idGenerator, что и Store, чтобы такое сообщение тоже можно было
+// подтвердить через DELETE /{queue}/{id}.
+type queueMessage struct {
+	id  uint64
+	msg string
 }
 
 // channelPool хранилище каналов, которые принимаю сообщения для их вывода.
 type channelPool struct {
-	pool map[string][](chan string)
+	pool map[string][](chan queueMessage)
 	mx   sync.Mutex
 }
 
 func NewHandlerPool() *channelPool {
 	return &channelPool{
-		pool: make(map[string][]chan string),
+		pool: make(map[string][]chan queueMessage),
 	}
 }
 
 // addToQueue добавляет канал в очередь на получение сообщения.
-func (p *channelPool) addToQueue(queueName string, ch chan string) {
+func (p *channelPool) addToQueue(queueName string, ch chan queueMessage) {
 	p.mx.Lock()
 	defer p.mx.Unlock()
 
@@ -219,7 +379,7 @@ func (p *channelPool) addToQueue(queueName string, ch chan string) {
 }
 
 // removeFromQueue удаляет канал из очереди на получение сообщения.
-func (p *channelPool) removeFromQueue(queueName string, ch chan string) {
+func (p *channelPool) removeFromQueue(queueName string, ch chan queueMessage) {
 	p.mx.Lock()
 	defer p.mx.Unlock()
 
@@ -233,16 +393,25 @@ func (p *channelPool) removeFromQueue(queueName string, ch chan string) {
 }
 
 // sendMessage служит для отправки сообщения первому каналу из очереди.
-func (p *channelPool) sendMessage(key, msg string) bool {
+// Отправка неблокирующая: если слушатель уже отключился и не вычитывает
+// канал, sendMessage не должен вешать весь пул под своим мьютексом —
+// вызывающий код (putQueueHandler) в этом случае положит сообщение в
+// хранилище как при отсутствии слушателей вовсе.
+func (p *channelPool) sendMessage(key string, msg queueMessage) bool {
 	p.mx.Lock()
 	defer p.mx.Unlock()
 
 	handlers, ok := p.pool[key]
-	if ok {
-		handlers[0] <- msg
+	if !ok || len(handlers) == 0 {
+		return false
+	}
+
+	select {
+	case handlers[0] <- msg:
 		return true
+	default:
+		return false
 	}
-	return false
 }
 
 // getQueueName возвращает имя очереди и признак его присутствия в URL.
@@ -262,8 +431,46 @@ func getQueueMessage(u *url.URL) (string, bool) {
 	return msg, msg != ""
 }
 
-// getRequestTimeout возвращает таймаут в секундах и признак его присутствия в URL.
-func getRequestTimeout(u *url.URL) (time.Duration, bool) {
+// getQueueMessageID разбирает путь вида /{queue}/{id} (ack) или
+// /{queue}/{id}/nack (nack) и возвращает имя очереди, ID сообщения и
+// признак того, что это nack.
+func getQueueMessageID(u *url.URL) (queue string, id uint64, isNack bool, ok bool) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 && len(parts) != 3 {
+		return "", 0, false, false
+	}
+	if len(parts) == 3 && parts[2] != "nack" {
+		return "", 0, false, false
+	}
+
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, false, false
+	}
+
+	return parts[0], id, len(parts) == 3, true
+}
+
+// getVisibility возвращает visibility timeout из параметра ?visibility=N
+// (в секундах) или defaultVisibility, если он не задан или некорректен.
+func getVisibility(u *url.URL) time.Duration {
+	raw := u.Query().Get("visibility")
+	if raw == "" {
+		return defaultVisibility
+	}
+
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || n <= 0 {
+		return defaultVisibility
+	}
+
+	return time.Duration(n) * time.Second
+}
+
+// getRequestTimeout возвращает таймаут в секундах и признак его присутствия в
+// URL, ограниченный сверху значением max, чтобы long-poll запрос не мог
+// пережить WriteTimeout сервера.
+func getRequestTimeout(u *url.URL, max time.Duration) (time.Duration, bool) {
 	timeout := u.Query().Get("timeout")
 	if timeout == "" {
 		return 0, false
@@ -273,26 +480,17 @@ func getRequestTimeout(u *url.URL) (time.Duration, bool) {
 	if err != nil {
 		return 0, false
 	}
-	// Возвращаем таймаут в секундах
-	return time.Duration(t) * time.Second, true
-}
-
-// popSlice вытаскивает первый элемент из слайса.
-func popSlice(s []string) (string, []string) {
-	if len(s) == 0 {
-		return "", nil
+	// Возвращаем таймаут в секундах, не превышающий max
+	d := time.Duration(t) * time.Second
+	if d > max {
+		d = max
 	}
-
-	item := s[0]
-
-	new := make([]string, len(s)-1)
-	copy(new, s[1:])
-	return item, new
+	return d, true
 }
 
 // removeItem удаляет элемент из слайса.
-func removeItem(s []chan string, item chan string) []chan string {
-	new := make([]chan string, len(s)-1)
+func removeItem[T comparable](s []T, item T) []T {
+	new := make([]T, len(s)-1)
 
 	for i, v := range s {
 		if v == item {
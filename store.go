@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Store абстрагирует хранение сообщений очередей от их доставки, чтобы
+// обработчики (put/get) не зависели от того, memoryStore это или walStore.
+// ID сообщения выделяется снаружи (idGenerator) и лишь проходит через
+// Store, поэтому один и тот же ID остаётся стабильным идентификатором
+// сообщения для ack/nack даже после requeueFront.
+type Store interface {
+	// push кладёт сообщение с заданным ID в конец очереди key.
+	push(key string, id uint64, msg string)
+	// pop забирает первое сообщение очереди key вместе с его ID. Сообщение
+	// считается лишь выданным (checked out), а не подтверждённым -
+	// durable-хранилища не должны считать его удалённым насовсем, пока не
+	// вызван ack.
+	pop(key string) (id uint64, msg string, ok bool)
+	// ack окончательно подтверждает обработку ранее выданного pop
+	// сообщения с идентификатором id.
+	ack(key string, id uint64)
+	// requeueFront возвращает ранее выданное pop сообщение в начало
+	// очереди key под тем же ID - используется при nack и истечении
+	// visibility timeout.
+	requeueFront(key string, id uint64, msg string)
+	// depth возвращает текущее число сообщений в очереди key.
+	depth(key string) int
+}
+
+// newStoreFromFlag создаёт Store по значению флага -store: "memory" - для
+// чистого in-memory хранилища, "wal:/path/to/dir" - для durable-хранилища
+// с журналом упреждающей записи в указанной директории.
+func newStoreFromFlag(value string, fsyncPolicy fsyncPolicy) (Store, error) {
+	if value == "" || value == "memory" {
+		return newMemoryStore(), nil
+	}
+
+	dir, ok := strings.CutPrefix(value, "wal:")
+	if !ok {
+		return nil, fmt.Errorf("store: неизвестное значение %q, ожидалось \"memory\" или \"wal:/path\"", value)
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("store: не указан путь для wal-хранилища")
+	}
+
+	return newWALStore(dir, fsyncPolicy)
+}
+
+// memoryEntry - сообщение в очереди memoryStore вместе с его ID.
+type memoryEntry struct {
+	id  uint64
+	msg string
+}
+
+// memoryStore - хранилище очереди сообщений по ключу, живущее только в
+// памяти процесса.
+type memoryStore struct {
+	mx   sync.Mutex
+	data map[string][]memoryEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		data: make(map[string][]memoryEntry),
+	}
+}
+
+// push кладёт сообщение с заданным ID в конец очереди key.
+func (s *memoryStore) push(key string, id uint64, msg string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.data[key] = append(s.data[key], memoryEntry{id: id, msg: msg})
+}
+
+// pop забирает первое сообщение ключа с удалением его из хранилища. Для
+// memoryStore это равносильно ack - подтверждать отдельно нечего, так как
+// нет журнала, который нужно было бы дозаписать надгробием.
+func (s *memoryStore) pop(key string) (uint64, string, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	entries, ok := s.data[key]
+	if !ok || len(entries) == 0 {
+		return 0, "", false
+	}
+
+	e := entries[0]
+	if len(entries) == 1 {
+		delete(s.data, key)
+	} else {
+		rest := make([]memoryEntry, len(entries)-1)
+		copy(rest, entries[1:])
+		s.data[key] = rest
+	}
+
+	return e.id, e.msg, true
+}
+
+// ack для memoryStore - no-op: сообщение уже удалено из хранилища в pop.
+func (s *memoryStore) ack(key string, id uint64) {}
+
+// requeueFront возвращает сообщение в начало очереди под тем же ID.
+func (s *memoryStore) requeueFront(key string, id uint64, msg string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.data[key] = append([]memoryEntry{{id: id, msg: msg}}, s.data[key]...)
+}
+
+// depth возвращает текущее число сообщений в очереди key.
+func (s *memoryStore) depth(key string) int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return len(s.data[key])
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSegmentMaxBytes - размер сегмента журнала, при превышении которого
+// walStore переключается на новый файл.
+const defaultSegmentMaxBytes = 16 * 1024 * 1024
+
+// fsyncPolicy описывает, как часто walStore должен вызывать fsync на текущий
+// сегмент, позволяя оператору выбирать между durability и throughput.
+type fsyncPolicy struct {
+	mode     string // "always", "interval" или "never"
+	interval time.Duration
+}
+
+// parseFsyncPolicy разбирает значение флага -fsync ("always", "never" или
+// "interval=Ns").
+func parseFsyncPolicy(value string) (fsyncPolicy, error) {
+	switch {
+	case value == "" || value == "always":
+		return fsyncPolicy{mode: "always"}, nil
+	case value == "never":
+		return fsyncPolicy{mode: "never"}, nil
+	case strings.HasPrefix(value, "interval="):
+		raw := strings.TrimSuffix(strings.TrimPrefix(value, "interval="), "s")
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return fsyncPolicy{}, fmt.Errorf("fsync: неверный интервал %q", value)
+		}
+		return fsyncPolicy{mode: "interval", interval: time.Duration(seconds) * time.Second}, nil
+	default:
+		return fsyncPolicy{}, fmt.Errorf("fsync: неизвестная политика %q, ожидалось always, never или interval=Ns", value)
+	}
+}
+
+// walRecord - это одна запись журнала упреждающей записи.
+type walRecord struct {
+	Op        string `json:"op"` // "push" или "pop"
+	Queue     string `json:"queue"`
+	Msg       string `json:"msg,omitempty"`
+	ID        uint64 `json:"id"`
+	Timestamp int64  `json:"ts"`
+}
+
+// walSegment - один файл журнала вместе с учётом того, какие ID сообщений в
+// него записаны и какие из них уже помечены надгробиями (tombstone). Когда
+// множества совпадают, сегмент можно целиком удалить.
+type walSegment struct {
+	index int
+	path  string
+	file  *os.File
+	size  int64
+
+	pushed     map[uint64]struct{}
+	tombstoned map[uint64]struct{}
+}
+
+func (s *walSegment) compactable(isCurrent bool) bool {
+	if isCurrent || len(s.pushed) == 0 {
+		return false
+	}
+	return len(s.tombstoned) >= len(s.pushed)
+}
+
+// walEntry - сообщение в очереди walStore вместе с идентификатором его
+// push-записи, нужным для последующей записи tombstone при pop.
+type walEntry struct {
+	id  uint64
+	msg string
+	seg *walSegment
+}
+
+// walStore - хранилище очередей, переживающее перезапуск процесса: каждое
+// push/pop дописывается в сегментированный журнал на диске, а состояние
+// очередей восстанавливается воспроизведением журнала при старте.
+type walStore struct {
+	mx sync.Mutex
+
+	dir             string
+	segmentMaxBytes int64
+	fsync           fsyncPolicy
+
+	data       map[string][]walEntry
+	checkedOut map[uint64]walEntry
+	segments   []*walSegment
+	maxID      uint64
+}
+
+// newWALStore открывает (или создаёт) журнал в директории dir и
+// восстанавливает по нему состояние очередей.
+func newWALStore(dir string, fsync fsyncPolicy) (*walStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("wal: создание директории: %w", err)
+	}
+
+	s := &walStore{
+		dir:             dir,
+		segmentMaxBytes: defaultSegmentMaxBytes,
+		fsync:           fsync,
+		data:            make(map[string][]walEntry),
+		checkedOut:      make(map[uint64]walEntry),
+	}
+
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+
+	if fsync.mode == "interval" {
+		go s.fsyncLoop()
+	}
+
+	return s, nil
+}
+
+// recover читает все существующие сегменты по возрастанию индекса и
+// проигрывает их поверх пустого состояния, затем открывает последний
+// сегмент на дозапись (или создаёт первый, если журнал пуст).
+func (s *walStore) recover() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "segment-*.log"))
+	if err != nil {
+		return fmt.Errorf("wal: чтение директории: %w", err)
+	}
+	sort.Strings(paths)
+
+	// pushSegments запоминает, в каком сегменте лежит push-запись каждого
+	// ID, встреченного по ходу восстановления - tombstone почти всегда
+	// физически попадает в другой (текущий на момент ack) сегмент, и без
+	// этой карты tombstone был бы ошибочно засчитан сегменту, в котором
+	// он лежит, а не тому, чей push он гасит.
+	pushSegments := make(map[uint64]*walSegment)
+
+	for _, path := range paths {
+		index, err := segmentIndex(path)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+		if err != nil {
+			return fmt.Errorf("wal: открытие сегмента %s: %w", path, err)
+		}
+
+		seg := &walSegment{
+			index:      index,
+			path:       path,
+			file:       f,
+			pushed:     make(map[uint64]struct{}),
+			tombstoned: make(map[uint64]struct{}),
+		}
+
+		size, err := s.replaySegment(seg, pushSegments)
+		if err != nil {
+			return err
+		}
+		seg.size = size
+
+		// replaySegment останавливается на первой неполной/битой записи -
+		// это либо физический конец файла, либо мусор, оставшийся после
+		// падения процесса посреди записи. Обрезаем файл до офсета
+		// последней целой записи, чтобы новые записи дописывались сразу
+		// за ней, а не после мусора: иначе следующее восстановление снова
+		// упрётся в этот мусор раньше валидных записей и молча потеряет их.
+		if err := seg.file.Truncate(size); err != nil {
+			return fmt.Errorf("wal: обрезка сегмента %s: %w", path, err)
+		}
+		if _, err := f.Seek(size, io.SeekStart); err != nil {
+			return fmt.Errorf("wal: перемотка сегмента %s: %w", path, err)
+		}
+
+		s.segments = append(s.segments, seg)
+	}
+
+	if len(s.segments) == 0 {
+		return s.rotate()
+	}
+
+	return nil
+}
+
+// replaySegment воспроизводит записи одного сегмента поверх текущего
+// состояния in-memory очередей и обновляет maxID/учёт push-tombstone.
+// pushSegments - общая для всего recover() карта id→сегмент с push-записью,
+// по которой tombstone засчитывается сегменту-источнику, а не сегменту, в
+// котором физически лежит сама tombstone-запись.
+func (s *walStore) replaySegment(seg *walSegment, pushSegments map[uint64]*walSegment) (int64, error) {
+	r := bufio.NewReader(seg.file)
+	var offset int64
+
+	for {
+		rec, n, err := readWALRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Незавершённая запись в хвосте журнала - типичный след
+			// падения процесса посреди записи. Обрезаем журнал до
+			// последней целой записи и продолжаем работу.
+			break
+		}
+		offset += n
+
+		if rec.ID > s.maxID {
+			s.maxID = rec.ID
+		}
+
+		switch rec.Op {
+		case "push":
+			seg.pushed[rec.ID] = struct{}{}
+			pushSegments[rec.ID] = seg
+			s.data[rec.Queue] = append(s.data[rec.Queue], walEntry{id: rec.ID, msg: rec.Msg, seg: seg})
+		case "pop":
+			pushSeg, ok := pushSegments[rec.ID]
+			if !ok {
+				// Не должно происходить в норме: tombstone всегда пишется
+				// после своего push. Засчитываем сегменту, в котором лежит
+				// сама tombstone-запись, чтобы не потерять учёт вовсе.
+				pushSeg = seg
+			}
+			pushSeg.tombstoned[rec.ID] = struct{}{}
+			removeWALEntry(s.data, rec.Queue, rec.ID)
+		}
+	}
+
+	return offset, nil
+}
+
+// push дописывает push-запись в журнал и добавляет сообщение в очередь под
+// заданным ID.
+func (s *walStore) push(key string, id uint64, msg string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if id > s.maxID {
+		s.maxID = id
+	}
+
+	seg := s.appendRecord(walRecord{Op: "push", Queue: key, Msg: msg, ID: id})
+
+	s.data[key] = append(s.data[key], walEntry{id: id, msg: msg, seg: seg})
+}
+
+// pop забирает первое сообщение из очереди и переводит его в состояние
+// checked out. Tombstone-запись в журнал не пишется: если процесс упадёт
+// до ack, воспроизведение журнала при старте увидит только push-запись и
+// вернёт сообщение обратно в очередь - это и даёт at-least-once доставку.
+func (s *walStore) pop(key string) (uint64, string, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	entries := s.data[key]
+	if len(entries) == 0 {
+		return 0, "", false
+	}
+
+	entry := entries[0]
+	if len(entries) == 1 {
+		delete(s.data, key)
+	} else {
+		rest := make([]walEntry, len(entries)-1)
+		copy(rest, entries[1:])
+		s.data[key] = rest
+	}
+
+	s.checkedOut[entry.id] = entry
+
+	return entry.id, entry.msg, true
+}
+
+// ack дописывает tombstone-запись для ранее выданного pop сообщения и по
+// возможности компактирует полностью погашенные сегменты.
+func (s *walStore) ack(key string, id uint64) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	entry, ok := s.checkedOut[id]
+	if !ok {
+		return
+	}
+	delete(s.checkedOut, id)
+
+	s.appendRecord(walRecord{Op: "pop", Queue: key, ID: id})
+	entry.seg.tombstoned[id] = struct{}{}
+
+	s.compact()
+}
+
+// requeueFront возвращает ранее выданное pop сообщение в начало очереди под
+// тем же ID. Журнал не трогаем: push-запись уже там и ещё не погашена.
+func (s *walStore) requeueFront(key string, id uint64, msg string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	entry, ok := s.checkedOut[id]
+	if ok {
+		delete(s.checkedOut, id)
+	} else {
+		// Не должно происходить в норме, но лучше вернуть сообщение в
+		// очередь без сегмента, чем потерять его.
+		entry = walEntry{id: id, msg: msg}
+	}
+
+	s.data[key] = append([]walEntry{entry}, s.data[key]...)
+}
+
+// MaxID возвращает наибольший ID сообщения, встреченный при восстановлении
+// журнала - используется, чтобы посеять внешний генератор ID и не выдать
+// после перезапуска идентификатор, который уже занят сообщением в журнале.
+func (s *walStore) MaxID() uint64 {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.maxID
+}
+
+// depth возвращает текущее число сообщений в очереди key.
+func (s *walStore) depth(key string) int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return len(s.data[key])
+}
+
+// appendRecord сериализует и дописывает запись в текущий сегмент, вращая
+// его при превышении лимита размера, и применяет политику fsync.
+func (s *walStore) appendRecord(rec walRecord) *walSegment {
+	rec.Timestamp = time.Now().UnixNano()
+
+	seg := s.segments[len(s.segments)-1]
+
+	buf, err := encodeWALRecord(rec)
+	if err != nil {
+		// Запись, которая не сериализуется в JSON, здесь невозможна:
+		// walRecord состоит только из строк и чисел.
+		panic(fmt.Sprintf("wal: encode record: %v", err))
+	}
+
+	if seg.size+int64(len(buf)) > s.segmentMaxBytes {
+		if err := s.rotate(); err != nil {
+			log.Fatal(err)
+		}
+		seg = s.segments[len(s.segments)-1]
+	}
+
+	n, err := seg.file.Write(buf)
+	if err != nil {
+		log.Fatal(fmt.Errorf("wal: запись в сегмент %s: %w", seg.path, err))
+	}
+	seg.size += int64(n)
+
+	if s.fsync.mode == "always" {
+		_ = seg.file.Sync()
+	}
+
+	if rec.Op == "push" {
+		seg.pushed[rec.ID] = struct{}{}
+	}
+
+	return seg
+}
+
+// rotate закрывает запись в текущий сегмент (если есть) и открывает новый.
+func (s *walStore) rotate() error {
+	index := 0
+	if len(s.segments) > 0 {
+		index = s.segments[len(s.segments)-1].index + 1
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("segment-%08d.log", index))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("wal: создание сегмента %s: %w", path, err)
+	}
+
+	s.segments = append(s.segments, &walSegment{
+		index:      index,
+		path:       path,
+		file:       f,
+		pushed:     make(map[uint64]struct{}),
+		tombstoned: make(map[uint64]struct{}),
+	})
+
+	return nil
+}
+
+// compact удаляет с диска сегменты, у которых каждая push-запись уже имеет
+// соответствующий tombstone. Вызывается под s.mx.
+func (s *walStore) compact() {
+	kept := s.segments[:0]
+
+	for i, seg := range s.segments {
+		isCurrent := i == len(s.segments)-1
+		if seg.compactable(isCurrent) {
+			seg.file.Close()
+			os.Remove(seg.path)
+			continue
+		}
+		kept = append(kept, seg)
+	}
+
+	s.segments = kept
+}
+
+// fsyncLoop периодически вызывает fsync на текущий сегмент согласно
+// политике "interval=Ns", чтобы не платить за durability на каждой записи.
+func (s *walStore) fsyncLoop() {
+	ticker := time.NewTicker(s.fsync.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mx.Lock()
+		if len(s.segments) > 0 {
+			_ = s.segments[len(s.segments)-1].file.Sync()
+		}
+		s.mx.Unlock()
+	}
+}
+
+// removeWALEntry удаляет из data[queue] запись с указанным ID (используется
+// при восстановлении, где tombstone может относиться не строго к головному
+// элементу, если push и pop оказались в разных сегментах не по порядку).
+func removeWALEntry(data map[string][]walEntry, queue string, id uint64) {
+	entries := data[queue]
+	for i, e := range entries {
+		if e.id == id {
+			data[queue] = append(entries[:i], entries[i+1:]...)
+			if len(data[queue]) == 0 {
+				delete(data, queue)
+			}
+			return
+		}
+	}
+}
+
+// segmentIndex извлекает числовой индекс из имени файла сегмента.
+func segmentIndex(path string) (int, error) {
+	base := strings.TrimSuffix(filepath.Base(path), ".log")
+	raw := strings.TrimPrefix(base, "segment-")
+	index, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("wal: неверное имя сегмента %s: %w", path, err)
+	}
+	return index, nil
+}
+
+// encodeWALRecord сериализует запись в формат [4 байта длина][JSON].
+func encodeWALRecord(rec walRecord) ([]byte, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	copy(buf[4:], body)
+	return buf, nil
+}
+
+// readWALRecord читает одну [4 байта длина][JSON] запись из r.
+func readWALRecord(r *bufio.Reader) (walRecord, int64, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return walRecord{}, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(lenBuf[:])
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return walRecord{}, 0, io.ErrUnexpectedEOF
+	}
+
+	var rec walRecord
+	if err := json.Unmarshal(body, &rec); err != nil {
+		return walRecord{}, 0, err
+	}
+
+	return rec, int64(4 + length), nil
+}
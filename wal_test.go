@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWALStoreRecoverAfterTornTailWrite проверяет сценарий из чанка 3:
+// процесс падает посреди записи, оставляя в хвосте сегмента неполную
+// запись. После восстановления новые записи должны лечь сразу за
+// последней целой записью, а не поверх физического конца файла с
+// мусором - иначе следующее восстановление снова упрётся в этот мусор
+// раньше валидных записей и молча потеряет их.
+func TestWALStoreRecoverAfterTornTailWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	s1, err := newWALStore(dir, fsyncPolicy{mode: "always"})
+	if err != nil {
+		t.Fatalf("newWALStore: %v", err)
+	}
+	s1.push("q", 1, "first")
+
+	segPath := filepath.Join(dir, "segment-00000000.log")
+	f, err := os.OpenFile(segPath, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	// Имитируем запись, прерванную падением процесса: валидный 4-байтовый
+	// префикс длины, но тело короче заявленного.
+	if _, err := f.Write([]byte{0, 0, 0, 42, 'x'}); err != nil {
+		t.Fatalf("write torn record: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close segment: %v", err)
+	}
+
+	s2, err := newWALStore(dir, fsyncPolicy{mode: "always"})
+	if err != nil {
+		t.Fatalf("newWALStore (recover 1): %v", err)
+	}
+	s2.push("q", 2, "second")
+
+	s3, err := newWALStore(dir, fsyncPolicy{mode: "always"})
+	if err != nil {
+		t.Fatalf("newWALStore (recover 2): %v", err)
+	}
+
+	if depth := s3.depth("q"); depth != 2 {
+		t.Fatalf("depth after second recovery = %d, want 2", depth)
+	}
+
+	id, msg, ok := s3.pop("q")
+	if !ok || id != 1 || msg != "first" {
+		t.Fatalf("pop #1 = (%d, %q, %v), want (1, \"first\", true)", id, msg, ok)
+	}
+	id, msg, ok = s3.pop("q")
+	if !ok || id != 2 || msg != "second" {
+		t.Fatalf("pop #2 = (%d, %q, %v), want (2, \"second\", true)", id, msg, ok)
+	}
+}
+
+// TestWALStoreCompactsAckedSegment проверяет, что полностью погашенный
+// (все push подтверждены ack) неактивный сегмент удаляется с диска, и
+// воспроизведение журнала после перезапуска не зависит от него.
+func TestWALStoreCompactsAckedSegment(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := newWALStore(dir, fsyncPolicy{mode: "always"})
+	if err != nil {
+		t.Fatalf("newWALStore: %v", err)
+	}
+	s.segmentMaxBytes = 135 // ровно столько, чтобы push #2 ушёл в новый сегмент, а pop ack ещё влез в него же
+
+	s.push("q", 1, "a")
+	s.push("q", 2, "b")
+
+	id, _, ok := s.pop("q")
+	if !ok || id != 1 {
+		t.Fatalf("pop #1 = (%d, %v), want (1, true)", id, ok)
+	}
+	s.ack("q", 1)
+
+	matches, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("segments on disk = %d, want 1 (acked segment should be compacted)", len(matches))
+	}
+
+	s2, err := newWALStore(dir, fsyncPolicy{mode: "always"})
+	if err != nil {
+		t.Fatalf("newWALStore (recover): %v", err)
+	}
+	if depth := s2.depth("q"); depth != 1 {
+		t.Fatalf("depth after recovery = %d, want 1", depth)
+	}
+}
+
+// TestWALStoreCompactsAckedSegmentAfterRestart проверяет, что сегмент,
+// полностью погашенный уже ПОСЛЕ перезапуска (его push и acking его
+// сообщений пришлись на разные процессы), всё равно компактируется -
+// tombstone при воспроизведении журнала должен быть засчитан сегменту,
+// хранящему push, а не сегменту, в котором физически лежит сама
+// tombstone-запись.
+func TestWALStoreCompactsAckedSegmentAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	s1, err := newWALStore(dir, fsyncPolicy{mode: "always"})
+	if err != nil {
+		t.Fatalf("newWALStore: %v", err)
+	}
+	s1.segmentMaxBytes = 135 // ровно столько, чтобы push #3 ушёл в новый сегмент
+
+	s1.push("q", 1, "a")
+	s1.push("q", 2, "b")
+	s1.push("q", 3, "c") // рождает segment-00000001.log
+
+	id, _, ok := s1.pop("q")
+	if !ok || id != 1 {
+		t.Fatalf("pop #1 = (%d, %v), want (1, true)", id, ok)
+	}
+	s1.ack("q", 1) // tombstone id=1 физически попадает в segment-00000001.log
+
+	s2, err := newWALStore(dir, fsyncPolicy{mode: "always"})
+	if err != nil {
+		t.Fatalf("newWALStore (recover 1): %v", err)
+	}
+	s2.segmentMaxBytes = 135
+
+	id, _, ok = s2.pop("q")
+	if !ok || id != 2 {
+		t.Fatalf("pop #2 = (%d, %v), want (2, true)", id, ok)
+	}
+	s2.ack("q", 2) // теперь все push сегмента 0 (id=1,2) погашены
+
+	matches, err := filepath.Glob(filepath.Join(dir, "segment-00000000.log"))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	if len(matches) != 0 {
+		t.Fatalf("segment-00000000.log still on disk, want compacted now that both its messages are acked")
+	}
+}